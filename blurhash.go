@@ -0,0 +1,166 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+const blurHashComponentsX = 4
+const blurHashComponentsY = 3
+
+const base83Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash computes a BlurHash placeholder string for img using the
+// blurHashComponentsX x blurHashComponentsY component variant.
+func blurHash(img image.Image) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	factors := make([][3]float64, blurHashComponentsX*blurHashComponentsY)
+
+	for j := 0; j < blurHashComponentsY; j++ {
+		for i := 0; i < blurHashComponentsX; i++ {
+			factors[j*blurHashComponentsX+i] = blurHashBasis(img, bounds, width, height, i, j)
+		}
+	}
+
+	dc := factors[0]
+	ac := factors[1:]
+
+	maxAC := 0.0
+	for _, factor := range ac {
+		for _, c := range factor {
+			if abs := math.Abs(c); abs > maxAC {
+				maxAC = abs
+			}
+		}
+	}
+
+	quantisedMaxAC := int(math.Max(0, math.Min(82, math.Floor(maxAC*166-0.5))))
+	maximumValue := float64(quantisedMaxAC+1) / 166
+
+	sizeFlag := (blurHashComponentsX - 1) + (blurHashComponentsY-1)*9
+
+	hash := base83Encode(sizeFlag, 1)
+
+	if len(ac) > 0 {
+		hash += base83Encode(quantisedMaxAC, 1)
+	} else {
+		hash += base83Encode(0, 1)
+	}
+
+	hash += base83Encode(blurHashEncodeDC(dc), 4)
+
+	for _, factor := range ac {
+		hash += base83Encode(blurHashEncodeAC(factor, maximumValue), 2)
+	}
+
+	return hash
+}
+
+// blurHashBasis averages rgb, linear over the image against the 2D DCT basis
+// function for component (i, j).
+func blurHashBasis(img image.Image, bounds image.Rectangle, width, height, i, j int) [3]float64 {
+	var r, g, b float64
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+				math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+
+			c := color.RGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.RGBA)
+
+			r += basis * srgbToLinear(c.R)
+			g += basis * srgbToLinear(c.G)
+			b += basis * srgbToLinear(c.B)
+		}
+	}
+
+	normalisation := 2.0
+	if i == 0 && j == 0 {
+		normalisation = 1
+	}
+
+	scale := normalisation / float64(width*height)
+
+	return [3]float64{r * scale, g * scale, b * scale}
+}
+
+func blurHashEncodeDC(rgb [3]float64) int {
+	r := linearToSrgb(rgb[0])
+	g := linearToSrgb(rgb[1])
+	b := linearToSrgb(rgb[2])
+
+	return (r << 16) + (g << 8) + b
+}
+
+func blurHashEncodeAC(rgb [3]float64, maximumValue float64) int {
+	quantise := func(value float64) int {
+		v := int(math.Floor(signPow(value/maximumValue, 0.5)*9 + 9.5))
+
+		if v < 0 {
+			return 0
+		}
+
+		if v > 18 {
+			return 18
+		}
+
+		return v
+	}
+
+	r, g, b := quantise(rgb[0]), quantise(rgb[1]), quantise(rgb[2])
+
+	return r*19*19 + g*19 + b
+}
+
+func signPow(value, exp float64) float64 {
+	sign := 1.0
+	if value < 0 {
+		sign = -1
+	}
+
+	return sign * math.Pow(math.Abs(value), exp)
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1.0/2.4)-0.055)*255 + 0.5)
+}
+
+func base83Encode(value, length int) string {
+	digits := make([]byte, length)
+
+	for i := 1; i <= length; i++ {
+		digit := (value / intPow(83, length-i)) % 83
+		digits[i-1] = base83Alphabet[digit]
+	}
+
+	return string(digits)
+}
+
+func intPow(base, exp int) int {
+	result := 1
+
+	for i := 0; i < exp; i++ {
+		result *= base
+	}
+
+	return result
+}
@@ -0,0 +1,21 @@
+// Package resize downscales decoded images for the responsive asset
+// variant pipeline.
+package resize
+
+import (
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// Resize scales img down to width, preserving its aspect ratio, using
+// Catmull-Rom interpolation.
+func Resize(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	return dst
+}
@@ -3,18 +3,27 @@ package main
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
+	stdjson "encoding/json"
 	"fmt"
+	"image"
+	_ "image/jpeg"
 	"image/png"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Kagami/go-avif"
 	"github.com/chai2010/webp"
 	"github.com/rjeczalik/notify"
 	"github.com/tdewolff/minify/v2"
@@ -22,13 +31,38 @@ import (
 	"github.com/tdewolff/minify/v2/js"
 	"github.com/tdewolff/minify/v2/json"
 	"gopkg.in/kothar/brotli-go.v0/enc"
+
+	"github.com/JRaspass/assets/internal/resize"
 )
 
 type Asset struct {
-	Br, Data, WebP []byte
-	Mime           string
+	AVIF, Br, Data, WebP []byte
+	BlurHash             string
+	Integrity            string
+	Mime                 string
+	Variants             map[int]Variant
+}
+
+// Variant is a downscaled rendition of an image asset at a fixed width.
+type Variant struct {
+	AVIF, WebP, Data []byte
+}
+
+// Srcset holds the width-descriptor srcset string for each format a
+// <picture> element can source an image from. The widths and URLs are
+// identical across fields; a source's AVIF/WebP/Data bytes are negotiated
+// per-request from the same path via the Accept header, so only formats a
+// variant was actually encoded in appear in the corresponding field.
+type Srcset struct {
+	AVIF, WebP, Data string
 }
 
+// variantWidths are the downscaled widths generated for images wider than
+// variantMinWidth.
+var variantWidths = []int{480, 960, 1920}
+
+const variantMinWidth = 960
+
 var cssAssetURL = regexp.MustCompile(`asset-url\('(.*?)'\)`)
 var cssSVGEmbed = regexp.MustCompile(`svg-embed\('(.*?)'(?:,(.*?))?\)`)
 var cssVariable = regexp.MustCompile(`var\(--(.*?)\)`)
@@ -62,18 +96,74 @@ var variables = map[string][]byte{
 }
 
 var assets map[string]Asset
+var currentFile string
 var dev = os.Getenv("DEV") == "1"
 var min = minify.New()
 var paths map[string]string
+var reverseDeps = map[string]map[string]bool{}
+var source map[string]string
+var srcset map[string]Srcset
+
+// assetsMu guards assets/paths/srcset, which the dev server reads from its
+// own goroutine while run()/reprocess() rebuild them on file changes.
+var assetsMu sync.RWMutex
+
+// addReverseDep records that currentFile depends on dep (via asset-url or
+// svg-embed), so reprocess can find it when dep changes.
+func addReverseDep(dep string) {
+	if reverseDeps[dep] == nil {
+		reverseDeps[dep] = map[string]bool{}
+	}
+
+	reverseDeps[dep][currentFile] = true
+}
+
+var sriAlgo = sriAlgoDefault()
+
+func sriAlgoDefault() string {
+	algo := os.Getenv("SRI_ALGO")
+
+	switch algo {
+	case "":
+		return "sha384"
+	case "sha256", "sha384", "sha512":
+		return algo
+	default:
+		panic("Unsupported SRI_ALGO: " + algo)
+	}
+}
+
+// integrity returns a Subresource Integrity string (e.g. "sha384-...") for
+// data, using the algorithm chosen by sriAlgo.
+func integrity(data []byte) string {
+	var sum []byte
+
+	switch sriAlgo {
+	case "sha256":
+		s := sha256.Sum256(data)
+		sum = s[:]
+	case "sha512":
+		s := sha512.Sum512(data)
+		sum = s[:]
+	default:
+		s := sha512.Sum384(data)
+		sum = s[:]
+	}
+
+	return sriAlgo + "-" + base64.StdEncoding.EncodeToString(sum)
+}
 
 func cssAssetURLFunc(match []byte) []byte {
 	file := cssAssetURL.FindStringSubmatch(string(match))[1]
+	addReverseDep(file)
 	return []byte("url(" + paths[file] + ")")
 }
 
 func cssSVGEmbedFunc(match []byte) []byte {
 	matches := cssSVGEmbed.FindStringSubmatch(string(match))
 
+	addReverseDep(matches[1])
+
 	svg, err := ioutil.ReadFile(matches[1])
 	if err != nil {
 		panic(err)
@@ -104,6 +194,169 @@ func manifestSrcFunc(match []byte) []byte {
 	return []byte(`"src":"` + paths[file] + `"`)
 }
 
+// encodeImage returns WebP and AVIF encodings of img. lossless should be set
+// for graphics-oriented source formats (e.g. PNG); photographic JPEG sources
+// are encoded lossy, since a lossless re-encode routinely balloons to
+// several times the size of the original.
+func encodeImage(img image.Image, lossless bool) (webpBytes, avifBytes []byte) {
+	webpOpts := &webp.Options{Lossless: lossless}
+	if !lossless {
+		webpOpts.Quality = 82
+	}
+
+	var webpBuf bytes.Buffer
+	if err := webp.Encode(&webpBuf, img, webpOpts); err != nil {
+		panic(err)
+	}
+
+	var avifBuf bytes.Buffer
+	if err := avif.Encode(&avifBuf, img, nil); err != nil {
+		panic(err)
+	}
+
+	return webpBuf.Bytes(), avifBuf.Bytes()
+}
+
+type remoteAsset struct {
+	URL     string            `json:"url"`
+	Path    string            `json:"path"`
+	SHA256  string            `json:"sha256"`
+	Headers map[string]string `json:"headers"`
+}
+
+// fetchRemoteAssets reads _remote.json (if present), downloads any entries
+// not already cached under .cache/, and returns a map of virtual path to
+// local cache file.
+func fetchRemoteAssets() map[string]string {
+	data, err := ioutil.ReadFile("_remote.json")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+
+	var remotes []remoteAsset
+	if err := stdjson.Unmarshal(data, &remotes); err != nil {
+		panic(err)
+	}
+
+	if err := os.MkdirAll(".cache", 0755); err != nil {
+		panic(err)
+	}
+
+	sources := map[string]string{}
+
+	for _, remote := range remotes {
+		sum := sha256.Sum256([]byte(remote.URL))
+		cache := filepath.Join(".cache", hex.EncodeToString(sum[:]))
+
+		if _, err := os.Stat(cache); os.IsNotExist(err) {
+			if err := downloadRemoteAsset(remote, cache); err != nil {
+				panic(err)
+			}
+		}
+
+		sources[remote.Path] = cache
+	}
+
+	return sources
+}
+
+func downloadRemoteAsset(remote remoteAsset, cache string) error {
+	req, err := http.NewRequest(http.MethodGet, remote.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range remote.Headers {
+		req.Header.Set(key, value)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("assets: %s: unexpected status %s", remote.URL, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if remote.SHA256 != "" {
+		sum := sha256.Sum256(body)
+		if hex.EncodeToString(sum[:]) != remote.SHA256 {
+			return fmt.Errorf("assets: %s sha256 mismatch", remote.URL)
+		}
+	}
+
+	return ioutil.WriteFile(cache, body, 0644)
+}
+
+var devPort = devPortDefault()
+
+func devPortDefault() string {
+	if port := os.Getenv("DEV_PORT"); port != "" {
+		return port
+	}
+
+	return "8080"
+}
+
+// startDevServer serves assets straight out of the in-memory assets/paths
+// maps, so reprocess can push updates without a rebuild or restart.
+func startDevServer() {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/assets/by-path/", devByPathHandler)
+	mux.HandleFunc("/assets/", devAssetHandler)
+
+	go func() {
+		if err := http.ListenAndServe(":"+devPort, mux); err != nil {
+			panic(err)
+		}
+	}()
+
+	fmt.Println("Dev asset server listening on :" + devPort)
+}
+
+func devAssetHandler(w http.ResponseWriter, r *http.Request) {
+	fingerprint := strings.TrimPrefix(r.URL.Path, "/assets/")
+
+	assetsMu.RLock()
+	asset, ok := assets[fingerprint]
+	assetsMu.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", asset.Mime)
+	w.Write(asset.Data)
+}
+
+func devByPathHandler(w http.ResponseWriter, r *http.Request) {
+	file := strings.TrimPrefix(r.URL.Path, "/assets/by-path/")
+
+	assetsMu.RLock()
+	path, ok := paths[file]
+	assetsMu.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Redirect(w, r, path, http.StatusFound)
+}
+
 func main() {
 	min.AddFunc("application/javascript", js.Minify)
 	min.AddFunc("application/manifest+json", json.Minify)
@@ -122,18 +375,45 @@ func main() {
 			panic(err)
 		}
 
-		var lastRun time.Time
+		startDevServer()
 
-		for {
-			event := <-c
+		wd, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
 
-			// Very crude debouncing.
-			if time.Since(lastRun) > time.Millisecond {
+		changed := map[string]bool{}
+
+		// Coalesce bursts of events into a single reprocess 150ms after the
+		// last one, instead of rebuilding everything on every event.
+		timer := time.NewTimer(150 * time.Millisecond)
+		if !timer.Stop() {
+			<-timer.C
+		}
+
+		for {
+			select {
+			case event := <-c:
 				fmt.Println(event)
-				run()
-			}
 
-			lastRun = time.Now()
+				if rel, err := filepath.Rel(wd, event.Path()); err == nil {
+					changed[rel] = true
+				}
+
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+
+				timer.Reset(150 * time.Millisecond)
+			case <-timer.C:
+				if len(changed) > 0 {
+					reprocess(changed)
+					changed = map[string]bool{}
+				}
+			}
 		}
 	}
 }
@@ -143,8 +423,11 @@ func run() {
 
 	var files []string
 
+	assetsMu.Lock()
 	assets = map[string]Asset{}
 	paths = map[string]string{}
+	srcset = map[string]Srcset{}
+	assetsMu.Unlock()
 
 	if err := filepath.Walk(".", func(file string, fi os.FileInfo, err error) error {
 		if !fi.IsDir() && !strings.HasPrefix(path.Base(file), "_") {
@@ -156,6 +439,13 @@ func run() {
 		panic(err)
 	}
 
+	source = map[string]string{}
+
+	for path, cache := range fetchRemoteAssets() {
+		files = append(files, path)
+		source[path] = cache
+	}
+
 	// Process images first because they could be referenced in other assets.
 	sort.Slice(files, func(i, j int) bool {
 		iImg := strings.HasPrefix(files[i], "images/")
@@ -176,82 +466,254 @@ func run() {
 	})
 
 	for _, file := range files {
-		ext := filepath.Ext(file)
+		processFile(file)
+	}
+
+	if !dev {
+		writeAssetsGo(start, len(files))
+	} else {
+		fmt.Println("Processed", len(files), "assets in", time.Since(start))
+	}
+}
 
-		if ext == ".go" {
+// reprocess re-runs processFile for each changed file plus anything that
+// depends on it (tracked in reverseDeps), instead of a full run().
+func reprocess(changed map[string]bool) {
+	start := time.Now()
+
+	seen := map[string]bool{}
+	queue := make([]string, 0, len(changed))
+
+	for file := range changed {
+		queue = append(queue, file)
+	}
+
+	for i := 0; i < len(queue); i++ {
+		file := queue[i]
+
+		if seen[file] {
 			continue
 		}
 
-		asset := Asset{Mime: mimes[ext]}
+		seen[file] = true
+		processFile(file)
 
-		if asset.Mime == "" {
-			panic("Unsupported: " + file)
+		for dependent := range reverseDeps[file] {
+			if !seen[dependent] {
+				queue = append(queue, dependent)
+			}
 		}
+	}
 
-		var err error
-		if asset.Data, err = ioutil.ReadFile(file); err != nil {
+	fmt.Println("Reprocessed", len(seen), "assets in", time.Since(start))
+}
+
+// removeAsset drops file (and anything processFile derived from it: its
+// responsive variants and srcset) from the assets/paths/srcset maps, and
+// forgets it as a reverse dependency. processFile emits no source maps, so
+// there are no .map entries to drop. Called when reprocess finds
+// file has been deleted or renamed out from under the watcher.
+func removeAsset(file string) {
+	if path, ok := paths[file]; ok {
+		delete(assets, strings.TrimPrefix(path, "/assets/"))
+		delete(paths, file)
+	}
+
+	for _, w := range variantWidths {
+		variantFile := fmt.Sprintf("%s@%d", file, w)
+
+		if path, ok := paths[variantFile]; ok {
+			delete(assets, strings.TrimPrefix(path, "/assets/"))
+			delete(paths, variantFile)
+		}
+	}
+
+	delete(srcset, file)
+	delete(reverseDeps, file)
+}
+
+// processFile reads, transforms and fingerprints a single asset, storing the
+// result (and any variants) into the assets/paths/srcset maps.
+func processFile(file string) {
+	ext := filepath.Ext(file)
+
+	if ext == ".go" {
+		return
+	}
+
+	// Held for the whole call: processFile reads other files' already-set
+	// paths entries (asset-url/svg-embed/assetPath lookups) while writing
+	// its own, and the dev server reads assets/paths/srcset concurrently.
+	assetsMu.Lock()
+	defer assetsMu.Unlock()
+
+	currentFile = file
+
+	asset := Asset{Mime: mimes[ext]}
+
+	if asset.Mime == "" {
+		panic("Unsupported: " + file)
+	}
+
+	readPath := file
+	if cache, ok := source[file]; ok {
+		readPath = cache
+	}
+
+	var err error
+	if asset.Data, err = ioutil.ReadFile(readPath); err != nil {
+		if os.IsNotExist(err) {
+			removeAsset(file)
+			return
+		}
+
+		panic(err)
+	}
+
+	switch ext {
+	case ".css":
+		asset.Data = cssAssetURL.ReplaceAllFunc(asset.Data, cssAssetURLFunc)
+		asset.Data = cssVariable.ReplaceAllFunc(asset.Data, cssVariableFunc)
+		fallthrough
+	case ".js", ".webmanifest":
+		asset.Data = jsAssetPath.ReplaceAllFunc(asset.Data, jsAssetPathFunc)
+
+		// Minify
+		if asset.Data, err = min.Bytes(asset.Mime, asset.Data); err != nil {
 			panic(err)
 		}
 
 		switch ext {
 		case ".css":
-			asset.Data = cssAssetURL.ReplaceAllFunc(asset.Data, cssAssetURLFunc)
-			asset.Data = cssVariable.ReplaceAllFunc(asset.Data, cssVariableFunc)
-			fallthrough
-		case ".js", ".webmanifest":
-			asset.Data = jsAssetPath.ReplaceAllFunc(asset.Data, jsAssetPathFunc)
-
-			// Minify
-			if asset.Data, err = min.Bytes(asset.Mime, asset.Data); err != nil {
+			// FIXME After minify because https://github.com/tdewolff/minify/issues/180
+			asset.Data = cssSVGEmbed.ReplaceAllFunc(asset.Data, cssSVGEmbedFunc)
+		case ".webmanifest":
+			asset.Data = manifestSrc.ReplaceAllFunc(asset.Data, manifestSrcFunc)
+		}
+	case ".svg":
+		asset.Data = cssVariable.ReplaceAllFunc(asset.Data, cssVariableFunc)
+	}
+
+	var img image.Image
+
+	if !dev {
+		// Brotli or WebP/AVIF
+		switch ext {
+		case ".css", ".js", ".svg":
+			if asset.Br, err = enc.CompressBuffer(nil, asset.Data, nil); err != nil {
 				panic(err)
 			}
+		case ".jpg", ".png":
+			if img, _, err = image.Decode(bytes.NewBuffer(asset.Data)); err != nil {
+				panic(err)
+			}
+
+			asset.WebP, asset.AVIF = encodeImage(img, ext == ".png")
+			asset.BlurHash = blurHash(img)
+
+			if width := img.Bounds().Dx(); width > variantMinWidth {
+				asset.Variants = map[int]Variant{}
+
+				for _, w := range variantWidths {
+					if w >= width {
+						continue
+					}
+
+					resized := resize.Resize(img, w)
+
+					var pngBuf bytes.Buffer
+					if err := png.Encode(&pngBuf, resized); err != nil {
+						panic(err)
+					}
 
-			switch ext {
-			case ".css":
-				// FIXME After minify because https://github.com/tdewolff/minify/issues/180
-				asset.Data = cssSVGEmbed.ReplaceAllFunc(asset.Data, cssSVGEmbedFunc)
-			case ".webmanifest":
-				asset.Data = manifestSrc.ReplaceAllFunc(asset.Data, manifestSrcFunc)
+					webpBytes, avifBytes := encodeImage(resized, ext == ".png")
+
+					asset.Variants[w] = Variant{
+						AVIF: avifBytes,
+						WebP: webpBytes,
+						Data: pngBuf.Bytes(),
+					}
+				}
 			}
-		case ".svg":
-			asset.Data = cssVariable.ReplaceAllFunc(asset.Data, cssVariableFunc)
 		}
+	}
 
-		if !dev {
-			// Brotli or WebP
-			switch ext {
-			case ".css", ".js", ".svg":
-				if asset.Br, err = enc.CompressBuffer(nil, asset.Data, nil); err != nil {
-					panic(err)
-				}
-			case ".png":
-				img, err := png.Decode(bytes.NewBuffer(asset.Data))
-				if err != nil {
-					panic(err)
-				}
+	asset.Integrity = integrity(asset.Data)
 
-				var buf bytes.Buffer
-				if err := webp.Encode(&buf, img, &webp.Options{Lossless: true}); err != nil {
-					panic(err)
-				}
+	hash := md5.Sum(asset.Data)
+	fingerprint := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	assets[fingerprint] = asset
+	paths[file] = "/assets/" + fingerprint
 
-				asset.WebP = buf.Bytes()
+	if len(asset.Variants) > 0 {
+		var avifEntries, webpEntries, dataEntries []string
+
+		for _, w := range variantWidths {
+			variant, ok := asset.Variants[w]
+			if !ok {
+				continue
+			}
+
+			vHash := md5.Sum(variant.Data)
+			vFingerprint := base64.RawURLEncoding.EncodeToString(vHash[:])
+			vPath := "/assets/" + vFingerprint
+
+			assets[vFingerprint] = Asset{
+				AVIF: variant.AVIF,
+				Data: variant.Data,
+				WebP: variant.WebP,
+				Mime: asset.Mime,
+			}
+			paths[fmt.Sprintf("%s@%d", file, w)] = vPath
+
+			descriptor := fmt.Sprintf("%s %dw", vPath, w)
+
+			if len(variant.AVIF) > 0 {
+				avifEntries = append(avifEntries, descriptor)
 			}
+			if len(variant.WebP) > 0 {
+				webpEntries = append(webpEntries, descriptor)
+			}
+			dataEntries = append(dataEntries, descriptor)
 		}
 
-		hash := md5.Sum(asset.Data)
-		fingerprint := base64.RawURLEncoding.EncodeToString(hash[:])
+		fullDescriptor := fmt.Sprintf("%s %dw", paths[file], img.Bounds().Dx())
+
+		if len(asset.AVIF) > 0 {
+			avifEntries = append(avifEntries, fullDescriptor)
+		}
+		if len(asset.WebP) > 0 {
+			webpEntries = append(webpEntries, fullDescriptor)
+		}
+		dataEntries = append(dataEntries, fullDescriptor)
 
-		assets[fingerprint] = asset
-		paths[file] = "/assets/" + fingerprint
+		srcset[file] = Srcset{
+			AVIF: strings.Join(avifEntries, ","),
+			WebP: strings.Join(webpEntries, ","),
+			Data: strings.Join(dataEntries, ","),
+		}
 	}
+}
+
+// writeAssetsGo writes gen/ and the embed.FS-backed assets.go for a
+// production (non-dev) build.
+func writeAssetsGo(start time.Time, fileCount int) {
+	writeGen()
 
 	file, err := os.Create("assets.go")
 	if err != nil {
 		panic(err)
 	}
 
-	if _, err := file.WriteString("package assets;var Paths=map[string]string{"); err != nil {
+	if _, err := file.WriteString(
+		"package assets\n\n" +
+			`import ("embed";"encoding/json";"io/fs")` + "\n\n" +
+			"//go:embed gen/*\n" +
+			"var genFS embed.FS\n\n" +
+			`const CrossOrigin = "anonymous"` + "\n\n" +
+			"var Paths = map[string]string{",
+	); err != nil {
 		panic(err)
 	}
 
@@ -261,27 +723,72 @@ func run() {
 		}
 	}
 
-	if _, err := file.WriteString(
-		"};var Assets=map[string]struct{Br,Data,WebP[]byte;Mime string}{",
-	); err != nil {
+	if _, err := file.WriteString("}\n\nvar Integrity = map[string]string{"); err != nil {
+		panic(err)
+	}
+
+	for path, hash := range paths {
+		fingerprint := strings.TrimPrefix(hash, "/assets/")
+
+		if _, err := fmt.Fprintf(file, "%#v:%#v,", path, assets[fingerprint].Integrity); err != nil {
+			panic(err)
+		}
+	}
+
+	if _, err := file.WriteString("}\n\nvar Srcset = map[string]struct{AVIF,WebP,Data string}{"); err != nil {
 		panic(err)
 	}
 
-	for hash, asset := range assets {
-		if _, err := fmt.Fprintf(
-			file,
-			"%#v:{[]byte(%#v),[]byte(%#v),[]byte(%#v),%#v},",
-			hash,
-			string(asset.Br),
-			string(asset.Data),
-			string(asset.WebP),
-			asset.Mime,
-		); err != nil {
+	for path, set := range srcset {
+		if _, err := fmt.Fprintf(file, "%#v:{%#v,%#v,%#v},", path, set.AVIF, set.WebP, set.Data); err != nil {
 			panic(err)
 		}
 	}
 
-	if _, err := file.WriteString("}"); err != nil {
+	index, err := stdjson.Marshal(genIndex())
+	if err != nil {
+		panic(err)
+	}
+
+	if _, err := fmt.Fprintf(
+		file,
+		"}\n\n"+
+			"type assetEntry struct{Mime,BlurHash,Integrity string;HasBr,HasWebP,HasAVIF bool}\n\n"+
+			"const indexJSON = %#v\n\n"+
+			"var Assets = map[string]struct{AVIF,Br,Data,WebP []byte;BlurHash,Integrity,Mime string}{}\n\n"+
+			"func init() {\n"+
+			"\tvar index map[string]assetEntry\n\n"+
+			"\tif err := json.Unmarshal([]byte(indexJSON), &index); err != nil {\n"+
+			"\t\tpanic(err)\n"+
+			"\t}\n\n"+
+			"\tfor fingerprint, entry := range index {\n"+
+			"\t\tdata, err := fs.ReadFile(genFS, \"gen/\"+fingerprint)\n"+
+			"\t\tif err != nil {\n"+
+			"\t\t\tpanic(err)\n"+
+			"\t\t}\n\n"+
+			"\t\tasset := struct{AVIF,Br,Data,WebP []byte;BlurHash,Integrity,Mime string}{\n"+
+			"\t\t\tData: data, BlurHash: entry.BlurHash, Integrity: entry.Integrity, Mime: entry.Mime,\n"+
+			"\t\t}\n\n"+
+			"\t\tif entry.HasBr {\n"+
+			"\t\t\tif asset.Br, err = fs.ReadFile(genFS, \"gen/\"+fingerprint+\".br\"); err != nil {\n"+
+			"\t\t\t\tpanic(err)\n"+
+			"\t\t\t}\n"+
+			"\t\t}\n\n"+
+			"\t\tif entry.HasWebP {\n"+
+			"\t\t\tif asset.WebP, err = fs.ReadFile(genFS, \"gen/\"+fingerprint+\".webp\"); err != nil {\n"+
+			"\t\t\t\tpanic(err)\n"+
+			"\t\t\t}\n"+
+			"\t\t}\n\n"+
+			"\t\tif entry.HasAVIF {\n"+
+			"\t\t\tif asset.AVIF, err = fs.ReadFile(genFS, \"gen/\"+fingerprint+\".avif\"); err != nil {\n"+
+			"\t\t\t\tpanic(err)\n"+
+			"\t\t\t}\n"+
+			"\t\t}\n\n"+
+			"\t\tAssets[fingerprint] = asset\n"+
+			"\t}\n"+
+			"}\n",
+		string(index),
+	); err != nil {
 		panic(err)
 	}
 
@@ -289,5 +796,66 @@ func run() {
 		panic(err)
 	}
 
-	fmt.Println("Processed", len(files), "assets in", time.Since(start))
+	fmt.Println("Processed", fileCount, "assets in", time.Since(start))
+}
+
+type assetIndexEntry struct {
+	Mime      string `json:"Mime"`
+	BlurHash  string `json:"BlurHash"`
+	Integrity string `json:"Integrity"`
+	HasBr     bool   `json:"HasBr"`
+	HasWebP   bool   `json:"HasWebP"`
+	HasAVIF   bool   `json:"HasAVIF"`
+}
+
+// genIndex builds the compact fingerprint-keyed index stored alongside the
+// embedded gen/ assets.
+func genIndex() map[string]assetIndexEntry {
+	index := make(map[string]assetIndexEntry, len(assets))
+
+	for fingerprint, asset := range assets {
+		index[fingerprint] = assetIndexEntry{
+			Mime:      asset.Mime,
+			BlurHash:  asset.BlurHash,
+			Integrity: asset.Integrity,
+			HasBr:     len(asset.Br) > 0,
+			HasWebP:   len(asset.WebP) > 0,
+			HasAVIF:   len(asset.AVIF) > 0,
+		}
+	}
+
+	return index
+}
+
+// writeGen writes each asset's raw bytes (plus .br/.webp/.avif siblings)
+// into gen/, which assets.go embeds via go:embed.
+func writeGen() {
+	if err := os.RemoveAll("gen"); err != nil {
+		panic(err)
+	}
+
+	if err := os.MkdirAll("gen", 0755); err != nil {
+		panic(err)
+	}
+
+	for fingerprint, asset := range assets {
+		if err := ioutil.WriteFile(filepath.Join("gen", fingerprint), asset.Data, 0644); err != nil {
+			panic(err)
+		}
+
+		for suffix, data := range map[string][]byte{
+			".br":   asset.Br,
+			".webp": asset.WebP,
+			".avif": asset.AVIF,
+		} {
+			if len(data) == 0 {
+				continue
+			}
+
+			path := filepath.Join("gen", fingerprint+suffix)
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				panic(err)
+			}
+		}
+	}
 }